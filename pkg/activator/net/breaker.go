@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package activator
+
+import (
+	"context"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// breaker is the interface the throttler uses to gate concurrent requests
+// to a single revision. queue.Breaker implements this interface for revisions
+// with a known, finite concurrency; InfiniteBreaker implements it for
+// revisions configured with unlimited (0) container concurrency.
+type breaker interface {
+	Capacity() int
+	Maybe(ctx context.Context, thunk func()) error
+	UpdateConcurrency(int)
+}
+
+// InfiniteBreaker is a breaker for the infinite concurrency case.
+// It always admits a request once at least one endpoint is known to be
+// ready, and blocks otherwise, waking up any waiters as soon as capacity
+// moves off zero.
+type InfiniteBreaker struct {
+	// mux guards `concurrency` and `broadcast`.
+	mux sync.RWMutex
+
+	// broadcast is closed and replaced every time `concurrency` is
+	// updated, to wake up any pending `Maybe` calls.
+	broadcast chan struct{}
+
+	// concurrency is the current number of ready backends for the revision.
+	concurrency int
+
+	logger *zap.SugaredLogger
+}
+
+// NewInfiniteBreaker creates a new breaker for the infinite concurrency case.
+func NewInfiniteBreaker(logger *zap.SugaredLogger) *InfiniteBreaker {
+	return &InfiniteBreaker{
+		broadcast: make(chan struct{}),
+		logger:    logger,
+	}
+}
+
+// Capacity returns the current capacity of the breaker, which for the
+// infinite case is just 0 or 1 (whether or not there is at least one pod).
+func (ib *InfiniteBreaker) Capacity() int {
+	ib.mux.RLock()
+	defer ib.mux.RUnlock()
+	return ib.concurrency
+}
+
+func (ib *InfiniteBreaker) updateConcurrency(cc int) {
+	ib.mux.Lock()
+	defer ib.mux.Unlock()
+	ib.concurrency = cc
+	// Wake up any pending `Maybe` calls with the new state of the world.
+	close(ib.broadcast)
+	ib.broadcast = make(chan struct{})
+}
+
+// UpdateConcurrency updates the capacity of the breaker.
+func (ib *InfiniteBreaker) UpdateConcurrency(cc int) {
+	ib.updateConcurrency(cc)
+}
+
+// Maybe executes thunk when the infinite breaker has capacity, blocking
+// until either capacity appears or the context is done.
+func (ib *InfiniteBreaker) Maybe(ctx context.Context, thunk func()) error {
+	for {
+		ib.mux.RLock()
+		cc := ib.concurrency
+		brd := ib.broadcast
+		ib.mux.RUnlock()
+
+		if cc > 0 {
+			thunk()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-brd:
+			// concurrency changed, loop around and check again.
+		}
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package activator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/retry"
+
+	"knative.dev/pkg/system"
+)
+
+// slotGrantsConfigMapName holds the leader's current per-activator slot
+// assignments, keyed by "<namespace>/<name>/<activator-id>". Followers
+// read it through the same ConfigMap informer every other knative
+// component uses for config, rather than standing up a dedicated gRPC
+// service just to hand out integers.
+const slotGrantsConfigMapName = "activator-slot-grants"
+
+// CoordinatorConfig turns on leader-elected capacity coordination: a
+// single activator (the elected leader) computes each activator's fair
+// share of a revision's capacity and publishes it for followers to read,
+// replacing the static MaxConcurrency/numActivators division that wastes
+// capacity when dests don't divide evenly across activators.
+type CoordinatorConfig struct {
+	// Enabled gates the whole feature; when false the Throttler falls
+	// back to the static per-activator division.
+	Enabled bool
+
+	// ID uniquely identifies this activator replica among the leader-
+	// election participants. It must match this replica's own address as
+	// it appears in the activator Service's Endpoints object (i.e. its
+	// pod IP), since that's what the leader uses as the grant key when it
+	// publishes each known activator's share.
+	ID string
+
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+// slotGrants is the structure serialized into the slot-grants ConfigMap.
+// Grants maps "namespace/name/activatorID" to the capacity that
+// activator should admit for that revision.
+type slotGrants struct {
+	Grants map[string]int `json:"grants"`
+}
+
+func grantKey(revID types.NamespacedName, activatorID string) string {
+	return fmt.Sprintf("%s/%s/%s", revID.Namespace, revID.Name, activatorID)
+}
+
+// coordinator tracks the leader-election state for a Throttler and, once
+// elected leader, computes and publishes slot grants; every replica
+// (leader included) reads grants back out of the same cache to decide
+// its own capacity share for a revision.
+type coordinator struct {
+	cfg    CoordinatorConfig
+	client kubernetes.Interface
+	logger *zap.SugaredLogger
+
+	mux      sync.RWMutex
+	isLeader bool
+	grants   map[string]int
+
+	// publishMux serializes publishGrant's read-modify-write of the
+	// slot-grants ConfigMap across this replica's goroutines.
+	publishMux sync.Mutex
+}
+
+func newCoordinator(cfg CoordinatorConfig, client kubernetes.Interface, logger *zap.SugaredLogger) *coordinator {
+	return &coordinator{
+		cfg:    cfg,
+		client: client,
+		logger: logger,
+		grants: make(map[string]int),
+	}
+}
+
+// run blocks running the leader-election loop until ctx is done. It is
+// meant to be started in its own goroutine by the Throttler.
+func (c *coordinator) run(ctx context.Context) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      "activator-throttler",
+			Namespace: system.Namespace(),
+		},
+		Client: c.client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: c.cfg.ID,
+		},
+	}
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: c.cfg.LeaseDuration,
+		RenewDeadline: c.cfg.RenewDeadline,
+		RetryPeriod:   c.cfg.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				c.setLeader(true)
+				c.logger.Infow("Became activator throttler coordinator", "id", c.cfg.ID)
+			},
+			OnStoppedLeading: func() {
+				c.setLeader(false)
+				c.logger.Infow("Stopped being activator throttler coordinator", "id", c.cfg.ID)
+			},
+		},
+	})
+}
+
+func (c *coordinator) setLeader(leader bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.isLeader = leader
+}
+
+func (c *coordinator) amLeader() bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.isLeader
+}
+
+// publishGrant is called by the leader once it has decided activatorID's
+// share of revID's capacity; it merges the new value into the shared
+// ConfigMap so followers (and the leader's own cache refresh) pick it up.
+//
+// publishGrantsIfLeader calls this once per known activator for each
+// revision, from both the endpoints-informer callback goroutine and the
+// Run() updateCh-consumer goroutine, so calls for different revisions would
+// otherwise race on the same ConfigMap's Get-then-Update. publishMux
+// serializes those calls within this replica, and the read-modify-write is
+// wrapped in RetryOnConflict so an Update that loses to a writer outside
+// this replica retries against a fresh copy instead of dropping its grant.
+func (c *coordinator) publishGrant(revID types.NamespacedName, activatorID string, capacity int) error {
+	if !c.amLeader() {
+		return nil
+	}
+	c.publishMux.Lock()
+	defer c.publishMux.Unlock()
+
+	cmClient := c.client.CoreV1().ConfigMaps(system.Namespace())
+	key := grantKey(revID, activatorID)
+
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, getErr := cmClient.Get(slotGrantsConfigMapName, metav1.GetOptions{})
+		grants := slotGrants{Grants: make(map[string]int)}
+		create := false
+		if getErr != nil {
+			if !apierrors.IsNotFound(getErr) {
+				return getErr
+			}
+			create = true
+		} else if raw, ok := cm.Data["grants"]; ok {
+			json.Unmarshal([]byte(raw), &grants)
+		}
+
+		grants.Grants[key] = capacity
+		encoded, err := json.Marshal(grants)
+		if err != nil {
+			return err
+		}
+
+		if create {
+			cm = &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      slotGrantsConfigMapName,
+					Namespace: system.Namespace(),
+				},
+				Data: map[string]string{"grants": string(encoded)},
+			}
+			_, err = cmClient.Create(cm)
+			return err
+		}
+		cm.Data["grants"] = string(encoded)
+		_, err = cmClient.Update(cm)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	c.mux.Lock()
+	c.grants[key] = capacity
+	c.mux.Unlock()
+	return nil
+}
+
+// grantFor returns the most recently observed capacity grant for this
+// activator and revision, and whether one has been published yet. Until
+// the leader publishes a first grant, callers should fall back to the
+// throttler's static division so capacity isn't withheld during startup.
+func (c *coordinator) grantFor(revID types.NamespacedName) (int, bool) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	capacity, ok := c.grants[grantKey(revID, c.cfg.ID)]
+	return capacity, ok
+}
+
+// onConfigMapUpdate refreshes this replica's cached view of the grants
+// ConfigMap; it is wired up as the handler for that ConfigMap's informer.
+func (c *coordinator) onConfigMapUpdate(cm *corev1.ConfigMap) {
+	if cm.Namespace != system.Namespace() || cm.Name != slotGrantsConfigMapName {
+		return
+	}
+	var grants slotGrants
+	if raw, ok := cm.Data["grants"]; ok {
+		if err := json.Unmarshal([]byte(raw), &grants); err != nil {
+			c.logger.Errorw("Failed to parse slot grants ConfigMap", zap.Error(err))
+			return
+		}
+	}
+	c.mux.Lock()
+	c.grants = grants.Grants
+	c.mux.Unlock()
+}
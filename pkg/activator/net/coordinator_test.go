@@ -0,0 +1,194 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package activator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	. "knative.dev/pkg/logging/testing"
+	"knative.dev/pkg/system"
+	_ "knative.dev/pkg/system/testing"
+	"knative.dev/serving/pkg/queue"
+)
+
+// TestTwoCoordinatorsShareOneLease spins up two coordinators racing for
+// the same Lease, via a shared fake clientset, and asserts that exactly
+// one of them becomes leader.
+func TestTwoCoordinatorsShareOneLease(t *testing.T) {
+	defer ClearAll()
+	client := kubefake.NewSimpleClientset()
+
+	cfgFor := func(id string) CoordinatorConfig {
+		return CoordinatorConfig{
+			Enabled:       true,
+			ID:            id,
+			LeaseDuration: 100 * time.Millisecond,
+			RenewDeadline: 50 * time.Millisecond,
+			RetryPeriod:   10 * time.Millisecond,
+		}
+	}
+
+	a := newCoordinator(cfgFor("activator-a"), client, TestLogger(t))
+	b := newCoordinator(cfgFor("activator-b"), client, TestLogger(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	go a.run(ctx)
+	go b.run(ctx)
+
+	time.Sleep(150 * time.Millisecond)
+
+	if a.amLeader() == b.amLeader() {
+		t.Fatalf("exactly one coordinator should be leader, got a=%v b=%v", a.amLeader(), b.amLeader())
+	}
+}
+
+func TestCoordinatorPublishAndReadGrant(t *testing.T) {
+	defer ClearAll()
+	client := kubefake.NewSimpleClientset()
+	c := newCoordinator(CoordinatorConfig{Enabled: true, ID: "activator-a"}, client, TestLogger(t))
+	c.setLeader(true)
+
+	revID := types.NamespacedName{Namespace: testNamespace, Name: testRevision}
+	if err := c.publishGrant(revID, "activator-a", 3); err != nil {
+		t.Fatalf("publishGrant() = %v", err)
+	}
+
+	got, ok := c.grantFor(revID)
+	if !ok || got != 3 {
+		t.Errorf("grantFor() = (%d, %v), want (3, true)", got, ok)
+	}
+}
+
+// TestPublishGrantConcurrentRevisionsDontDropEachOther races publishGrant
+// for many different revisions against the same shared ConfigMap, the way
+// updateActivatorCount's informer-callback goroutine and Run()'s updateCh-
+// consumer goroutine do in production. If these read-modify-writes were
+// allowed to interleave, a concurrent Update here would silently discard
+// another revision's grant; every revision's grant must land regardless of
+// how the calls are scheduled.
+func TestPublishGrantConcurrentRevisionsDontDropEachOther(t *testing.T) {
+	defer ClearAll()
+	client := kubefake.NewSimpleClientset()
+	c := newCoordinator(CoordinatorConfig{Enabled: true, ID: "activator-a"}, client, TestLogger(t))
+	c.setLeader(true)
+
+	const numRevisions = 20
+	revIDs := make([]types.NamespacedName, numRevisions)
+	for i := range revIDs {
+		revIDs[i] = types.NamespacedName{Namespace: testNamespace, Name: fmt.Sprintf("rev-%d", i)}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(numRevisions)
+	errs := make([]error, numRevisions)
+	for i, revID := range revIDs {
+		go func(i int, revID types.NamespacedName) {
+			defer wg.Done()
+			errs[i] = c.publishGrant(revID, "activator-a", i+1)
+		}(i, revID)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("publishGrant(%s) = %v, want no error", revIDs[i], err)
+		}
+	}
+
+	for i, revID := range revIDs {
+		got, ok := c.grantFor(revID)
+		if !ok || got != i+1 {
+			t.Errorf("grantFor(%s) = (%d, %v), want (%d, true)", revID, got, ok, i+1)
+		}
+	}
+
+	cm, err := client.CoreV1().ConfigMaps(system.Namespace()).Get(slotGrantsConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get(%s) = %v", slotGrantsConfigMapName, err)
+	}
+	var grants slotGrants
+	if err := json.Unmarshal([]byte(cm.Data["grants"]), &grants); err != nil {
+		t.Fatalf("Unmarshal() = %v", err)
+	}
+	for i, revID := range revIDs {
+		key := grantKey(revID, "activator-a")
+		if got := grants.Grants[key]; got != i+1 {
+			t.Errorf("grants[%s] = %d, want %d", key, got, i+1)
+		}
+	}
+}
+
+// TestThrottlerPublishesGrantsWhenLeader exercises the leader-side half
+// of the wiring: Throttler.publishGrantsIfLeader must compute and publish
+// a grant for every known activator once this replica is leader, so the
+// slot-grants ConfigMap actually ends up populated in production rather
+// than staying empty forever.
+func TestThrottlerPublishesGrantsWhenLeader(t *testing.T) {
+	defer ClearAll()
+	client := kubefake.NewSimpleClientset()
+	coord := newCoordinator(CoordinatorConfig{Enabled: true, ID: "10.0.0.1"}, client, TestLogger(t))
+	coord.setLeader(true)
+
+	revID := types.NamespacedName{Namespace: testNamespace, Name: testRevision}
+	rt := &revisionThrottler{
+		revID:                revID,
+		containerConcurrency: 10,
+		breaker: queue.NewBreaker(queue.BreakerParams{
+			QueueDepth:      1,
+			MaxConcurrency:  defaultMaxConcurrency,
+			InitialCapacity: 0,
+		}),
+		dests: sets.NewString("128.0.0.1:1234"),
+	}
+
+	th := &Throttler{
+		revisionThrottlers: map[types.NamespacedName]*revisionThrottler{revID: rt},
+		coordinator:        coord,
+		logger:             TestLogger(t),
+	}
+
+	activatorIDs := sets.NewString("10.0.0.1", "10.0.0.2")
+	th.publishGrantsIfLeader(rt, 4 /* numDests */, activatorIDs)
+
+	cm, err := client.CoreV1().ConfigMaps(system.Namespace()).Get(slotGrantsConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get(%s) = %v", slotGrantsConfigMapName, err)
+	}
+	var grants slotGrants
+	if err := json.Unmarshal([]byte(cm.Data["grants"]), &grants); err != nil {
+		t.Fatalf("Unmarshal() = %v", err)
+	}
+
+	const wantCapacity = 10 * 4 / 2 // containerConcurrency * numDests / len(activatorIDs)
+	for _, id := range activatorIDs.List() {
+		if got := grants.Grants[grantKey(revID, id)]; got != wantCapacity {
+			t.Errorf("grants[%s] = %d, want %d", grantKey(revID, id), got, wantCapacity)
+		}
+	}
+}
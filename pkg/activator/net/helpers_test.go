@@ -0,0 +1,90 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package activator
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"knative.dev/pkg/metrics/metricstest"
+	"knative.dev/serving/pkg/apis/networking"
+	"knative.dev/serving/pkg/apis/serving/v1alpha1"
+)
+
+const (
+	testNamespace = "test-namespace"
+	testRevision  = "test-revision"
+)
+
+// revision builds a minimal, ready Revision for the given id, with a
+// single-concurrency limit so breaker capacity math in these tests stays
+// easy to reason about (1 container-concurrency slot per dest).
+func revision(revID types.NamespacedName, protocol networking.ProtocolType) *v1alpha1.Revision {
+	return &v1alpha1.Revision{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: revID.Namespace,
+			Name:      revID.Name,
+		},
+		Spec: v1alpha1.RevisionSpec{
+			ContainerConcurrency: 1,
+			DeprecatedContainer: &corev1.Container{
+				Ports: []corev1.ContainerPort{{
+					Name: string(protocol),
+				}},
+			},
+		},
+	}
+}
+
+// revisionWithAnnotations is like revision, but also sets the given
+// annotations (e.g. LBPolicyAnnotationKey) on the Revision.
+func revisionWithAnnotations(revID types.NamespacedName, protocol networking.ProtocolType, annotations map[string]string) *v1alpha1.Revision {
+	rev := revision(revID, protocol)
+	rev.ObjectMeta.Annotations = annotations
+	return rev
+}
+
+// epSubset builds a single EndpointSubset with one port and one address
+// per given IP, mirroring how the activator Service's Endpoints object
+// looks in practice.
+func epSubset(port int32, portName string, ips []string) *corev1.EndpointSubset {
+	addrs := make([]corev1.EndpointAddress, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, corev1.EndpointAddress{IP: ip})
+	}
+	return &corev1.EndpointSubset{
+		Addresses: addrs,
+		Ports: []corev1.EndpointPort{{
+			Name: portName,
+			Port: port,
+		}},
+	}
+}
+
+// ClearAll resets the recorded OpenCensus view data between table-driven
+// test cases, so assertions on try_latency/queue_depth/breaker_capacity/
+// retries in one case can't see measurements left over from another.
+func ClearAll() {
+	metricstest.Unregister(
+		"try_latency",
+		"queue_depth",
+		"breaker_capacity",
+		"retries",
+	)
+	registerMetricsViews()
+}
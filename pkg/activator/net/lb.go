@@ -0,0 +1,307 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package activator
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// LBPolicyAnnotationKey lets a Revision pick which LoadBalancer
+// implementation the Throttler uses to choose among its healthy dests.
+// It lives alongside the other autoscaling.knative.dev annotations even
+// though it affects request routing rather than scaling, because it is
+// set and read in exactly the same way (a per-revision override).
+const LBPolicyAnnotationKey = "autoscaling.knative.dev/lb-policy"
+
+// LB policy names usable as the value of LBPolicyAnnotationKey.
+const (
+	LBPolicyRoundRobin        = "round-robin"
+	LBPolicyPowerOfTwoChoices = "p2c"
+	LBPolicyLeastInflight     = "least-inflight"
+	LBPolicyConsistentHash    = "consistent-hash"
+)
+
+// defaultLBPolicy is used for revisions that don't carry an explicit
+// LBPolicyAnnotationKey, preserving the throttler's historical behavior.
+const defaultLBPolicy = LBPolicyRoundRobin
+
+// LoadBalancer picks one of the ready dests for a revision and returns a
+// release func that the caller must invoke once the request finishes,
+// so inflight-count-based policies can keep their bookkeeping accurate.
+// release is never nil.
+type LoadBalancer interface {
+	Pick(dests sets.String, revID types.NamespacedName) (dest string, release func())
+}
+
+// keyedLoadBalancer is implemented by policies that can make use of a
+// request-supplied key (e.g. a header value) for dest selection, such as
+// consistent hashing. Throttler.TryWithKey prefers this over Pick when both
+// the policy and the caller supply a key.
+type keyedLoadBalancer interface {
+	PickForKey(dests sets.String, revID types.NamespacedName, key string) (dest string, release func())
+}
+
+// newLoadBalancer returns the LoadBalancer implementation for the given
+// policy name, falling back to round-robin for an empty or unknown value
+// so a typo in the annotation degrades gracefully rather than failing
+// requests.
+func newLoadBalancer(policy string) LoadBalancer {
+	switch policy {
+	case LBPolicyPowerOfTwoChoices:
+		return newP2CLoadBalancer()
+	case LBPolicyLeastInflight:
+		return newLeastInflightLoadBalancer()
+	case LBPolicyConsistentHash:
+		return newConsistentHashLoadBalancer()
+	default:
+		return newRoundRobinLoadBalancer()
+	}
+}
+
+func noopRelease() {}
+
+// roundRobinLoadBalancer cycles through the sorted dest set, matching the
+// throttler's original hard-wired behavior.
+type roundRobinLoadBalancer struct {
+	mu   sync.Mutex
+	next int
+}
+
+func newRoundRobinLoadBalancer() *roundRobinLoadBalancer {
+	return &roundRobinLoadBalancer{}
+}
+
+func (rr *roundRobinLoadBalancer) Pick(dests sets.String, _ types.NamespacedName) (string, func()) {
+	list := dests.List()
+	if len(list) == 0 {
+		return "", noopRelease
+	}
+	rr.mu.Lock()
+	idx := rr.next % len(list)
+	rr.next++
+	rr.mu.Unlock()
+	return list[idx], noopRelease
+}
+
+// inflightTracker is shared by the inflight-aware policies (P2C and
+// least-inflight) to count outstanding requests per dest, per revision.
+type inflightTracker struct {
+	mu     sync.Mutex
+	counts map[types.NamespacedName]map[string]int
+}
+
+func newInflightTracker() *inflightTracker {
+	return &inflightTracker{counts: make(map[types.NamespacedName]map[string]int)}
+}
+
+func (it *inflightTracker) inc(revID types.NamespacedName, dest string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	m, ok := it.counts[revID]
+	if !ok {
+		m = make(map[string]int)
+		it.counts[revID] = m
+	}
+	m[dest]++
+}
+
+func (it *inflightTracker) dec(revID types.NamespacedName, dest string) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	if m, ok := it.counts[revID]; ok {
+		m[dest]--
+		if m[dest] <= 0 {
+			delete(m, dest)
+		}
+	}
+}
+
+func (it *inflightTracker) get(revID types.NamespacedName, dest string) int {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return it.counts[revID][dest]
+}
+
+func (it *inflightTracker) release(revID types.NamespacedName, dest string) func() {
+	it.inc(revID, dest)
+	var once sync.Once
+	return func() {
+		once.Do(func() { it.dec(revID, dest) })
+	}
+}
+
+// p2cLoadBalancer implements power-of-two-choices: it samples two random
+// dests and picks the one with fewer in-flight requests, which spreads
+// load almost as evenly as "least of N" while comparing only two
+// in-flight counts per pick.
+type p2cLoadBalancer struct {
+	inflight *inflightTracker
+	rand     *rand.Rand
+	mu       sync.Mutex
+}
+
+func newP2CLoadBalancer() *p2cLoadBalancer {
+	return &p2cLoadBalancer{
+		inflight: newInflightTracker(),
+		rand:     rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (lb *p2cLoadBalancer) Pick(dests sets.String, revID types.NamespacedName) (string, func()) {
+	list := dests.List()
+	if len(list) == 0 {
+		return "", noopRelease
+	}
+	if len(list) == 1 {
+		return list[0], lb.inflight.release(revID, list[0])
+	}
+
+	lb.mu.Lock()
+	i, j := lb.rand.Intn(len(list)), lb.rand.Intn(len(list)-1)
+	lb.mu.Unlock()
+	if j >= i {
+		j++
+	}
+
+	a, b := list[i], list[j]
+	dest := a
+	if lb.inflight.get(revID, b) < lb.inflight.get(revID, a) {
+		dest = b
+	}
+	return dest, lb.inflight.release(revID, dest)
+}
+
+// leastInflightLoadBalancer always picks the dest with the fewest
+// outstanding requests, scanning the full candidate set on every pick.
+type leastInflightLoadBalancer struct {
+	inflight *inflightTracker
+}
+
+func newLeastInflightLoadBalancer() *leastInflightLoadBalancer {
+	return &leastInflightLoadBalancer{inflight: newInflightTracker()}
+}
+
+func (lb *leastInflightLoadBalancer) Pick(dests sets.String, revID types.NamespacedName) (string, func()) {
+	list := dests.List()
+	if len(list) == 0 {
+		return "", noopRelease
+	}
+	best := list[0]
+	bestCount := lb.inflight.get(revID, best)
+	for _, d := range list[1:] {
+		if c := lb.inflight.get(revID, d); c < bestCount {
+			best, bestCount = d, c
+		}
+	}
+	return best, lb.inflight.release(revID, best)
+}
+
+// consistentHashVirtualNodes is how many points each real dest occupies
+// on the ring. More virtual nodes spread the ring's gaps more evenly
+// across dests, at the cost of a bigger ring to search.
+const consistentHashVirtualNodes = 100
+
+// ringPoint is one point on the hash ring: hash is where it sits, dest is
+// the real dest it maps back to.
+type ringPoint struct {
+	hash uint32
+	dest string
+}
+
+// consistentHashLoadBalancer maps a request-supplied key onto a point on
+// a hash ring built from the current dest set, so that requests sharing
+// a key keep landing on the same dest while the set is stable, and a
+// dest joining or leaving only remaps the fraction of keys that land
+// near it on the ring -- not the whole keyspace, the way a plain
+// hash(key) % len(dests) scheme would on every dest-count change.
+// Callers that don't supply a key (via PickForKey) fall back to Pick,
+// which picks uniformly at random -- there is no sticky key to honor.
+type consistentHashLoadBalancer struct {
+	rand *rand.Rand
+
+	mu       sync.Mutex
+	builtFor sets.String
+	ring     []ringPoint
+}
+
+func newConsistentHashLoadBalancer() *consistentHashLoadBalancer {
+	return &consistentHashLoadBalancer{rand: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+func hash32(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// ringFor returns the hash ring for dests, rebuilding it only when the
+// dest set has actually changed since the last call.
+func (lb *consistentHashLoadBalancer) ringFor(dests sets.String) []ringPoint {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.builtFor != nil && lb.builtFor.Equal(dests) {
+		return lb.ring
+	}
+
+	list := dests.List()
+	ring := make([]ringPoint, 0, len(list)*consistentHashVirtualNodes)
+	for _, dest := range list {
+		for v := 0; v < consistentHashVirtualNodes; v++ {
+			ring = append(ring, ringPoint{hash: hash32(fmt.Sprintf("%s#%d", dest, v)), dest: dest})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	lb.builtFor = dests
+	lb.ring = ring
+	return ring
+}
+
+func (lb *consistentHashLoadBalancer) Pick(dests sets.String, _ types.NamespacedName) (string, func()) {
+	list := dests.List()
+	if len(list) == 0 {
+		return "", noopRelease
+	}
+	lb.mu.Lock()
+	idx := lb.rand.Intn(len(list))
+	lb.mu.Unlock()
+	return list[idx], noopRelease
+}
+
+func (lb *consistentHashLoadBalancer) PickForKey(dests sets.String, _ types.NamespacedName, key string) (string, func()) {
+	if dests.Len() == 0 {
+		return "", noopRelease
+	}
+	if key == "" {
+		return lb.Pick(dests, types.NamespacedName{})
+	}
+
+	ring := lb.ringFor(dests)
+	h := hash32(key)
+	idx := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if idx == len(ring) {
+		idx = 0
+	}
+	return ring[idx].dest, noopRelease
+}
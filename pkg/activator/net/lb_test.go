@@ -0,0 +1,187 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package activator
+
+import (
+	"fmt"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+var testRevID = types.NamespacedName{Namespace: testNamespace, Name: testRevision}
+
+func TestNewLoadBalancer(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		want   LoadBalancer
+	}{
+		{"", &roundRobinLoadBalancer{}},
+		{LBPolicyRoundRobin, &roundRobinLoadBalancer{}},
+		{"bogus-policy", &roundRobinLoadBalancer{}},
+		{LBPolicyPowerOfTwoChoices, &p2cLoadBalancer{}},
+		{LBPolicyLeastInflight, &leastInflightLoadBalancer{}},
+		{LBPolicyConsistentHash, &consistentHashLoadBalancer{}},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			got := newLoadBalancer(tc.policy)
+			switch tc.want.(type) {
+			case *roundRobinLoadBalancer:
+				if _, ok := got.(*roundRobinLoadBalancer); !ok {
+					t.Errorf("newLoadBalancer(%q) = %T, want *roundRobinLoadBalancer", tc.policy, got)
+				}
+			case *p2cLoadBalancer:
+				if _, ok := got.(*p2cLoadBalancer); !ok {
+					t.Errorf("newLoadBalancer(%q) = %T, want *p2cLoadBalancer", tc.policy, got)
+				}
+			case *leastInflightLoadBalancer:
+				if _, ok := got.(*leastInflightLoadBalancer); !ok {
+					t.Errorf("newLoadBalancer(%q) = %T, want *leastInflightLoadBalancer", tc.policy, got)
+				}
+			case *consistentHashLoadBalancer:
+				if _, ok := got.(*consistentHashLoadBalancer); !ok {
+					t.Errorf("newLoadBalancer(%q) = %T, want *consistentHashLoadBalancer", tc.policy, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRoundRobinSkew(t *testing.T) {
+	lb := newRoundRobinLoadBalancer()
+	dests := sets.NewString("10.0.0.1:8012", "10.0.0.2:8012", "10.0.0.3:8012")
+
+	got := sets.NewString()
+	for i := 0; i < dests.Len(); i++ {
+		dest, release := lb.Pick(dests, testRevID)
+		release()
+		got.Insert(dest)
+	}
+
+	if !got.Equal(dests) {
+		t.Errorf("round-robin over one full cycle = %v, want every dest exactly once: %v", got, dests)
+	}
+}
+
+func TestRoundRobinDestChurn(t *testing.T) {
+	lb := newRoundRobinLoadBalancer()
+	dests := sets.NewString("10.0.0.1:8012", "10.0.0.2:8012")
+
+	// Pick once, then the informer drops a dest out from under us.
+	dest, release := lb.Pick(dests, testRevID)
+	release()
+	if !dests.Has(dest) {
+		t.Errorf("Pick() = %s, not in %v", dest, dests)
+	}
+
+	shrunk := sets.NewString("10.0.0.2:8012")
+	dest, release = lb.Pick(shrunk, testRevID)
+	release()
+	if dest != "10.0.0.2:8012" {
+		t.Errorf("Pick() after churn = %s, want 10.0.0.2:8012", dest)
+	}
+}
+
+func TestLeastInflightPrefersIdleDest(t *testing.T) {
+	lb := newLeastInflightLoadBalancer()
+	dests := sets.NewString("10.0.0.1:8012", "10.0.0.2:8012")
+
+	// Occupy the first dest returned and keep its release held so its
+	// inflight count stays elevated for the next Pick.
+	first, releaseFirst := lb.Pick(dests, testRevID)
+	other := "10.0.0.1:8012"
+	if first == other {
+		other = "10.0.0.2:8012"
+	}
+
+	second, releaseSecond := lb.Pick(dests, testRevID)
+	releaseSecond()
+	releaseFirst()
+
+	if second != other {
+		t.Errorf("Pick() while %s is inflight = %s, want %s", first, second, other)
+	}
+}
+
+func TestP2CPicksFromCandidateSet(t *testing.T) {
+	lb := newP2CLoadBalancer()
+	dests := sets.NewString("10.0.0.1:8012", "10.0.0.2:8012", "10.0.0.3:8012")
+
+	for i := 0; i < 10; i++ {
+		dest, release := lb.Pick(dests, testRevID)
+		release()
+		if !dests.Has(dest) {
+			t.Fatalf("Pick() = %s, not in %v", dest, dests)
+		}
+	}
+}
+
+func TestConsistentHashIsStickyForKey(t *testing.T) {
+	lb := newConsistentHashLoadBalancer()
+	dests := sets.NewString("10.0.0.1:8012", "10.0.0.2:8012", "10.0.0.3:8012")
+
+	want, release := lb.PickForKey(dests, testRevID, "session-abc")
+	release()
+	for i := 0; i < 10; i++ {
+		got, release := lb.PickForKey(dests, testRevID, "session-abc")
+		release()
+		if got != want {
+			t.Errorf("PickForKey() = %s, want sticky %s", got, want)
+		}
+	}
+}
+
+func TestConsistentHashNoKeyFallsBackToPick(t *testing.T) {
+	lb := newConsistentHashLoadBalancer()
+	dests := sets.NewString("10.0.0.1:8012")
+
+	dest, release := lb.PickForKey(dests, testRevID, "")
+	release()
+	if dest != "10.0.0.1:8012" {
+		t.Errorf("PickForKey() with empty key = %s, want 10.0.0.1:8012", dest)
+	}
+}
+
+// TestConsistentHashMinimizesRemappingOnChurn checks the property that
+// makes consistent hashing worth using over a plain hash(key)%len(dests)
+// scheme: adding a dest should only remap the keys that happen to land
+// near the new dest's ring points, not a large fraction of the keyspace.
+func TestConsistentHashMinimizesRemappingOnChurn(t *testing.T) {
+	lb := newConsistentHashLoadBalancer()
+	before := sets.NewString("10.0.0.1:8012", "10.0.0.2:8012", "10.0.0.3:8012")
+	after := sets.NewString("10.0.0.1:8012", "10.0.0.2:8012", "10.0.0.3:8012", "10.0.0.4:8012")
+
+	const numKeys = 2000
+	remapped := 0
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("session-%d", i)
+		want, release := lb.PickForKey(before, testRevID, key)
+		release()
+		got, release := lb.PickForKey(after, testRevID, key)
+		release()
+		if got != want {
+			remapped++
+		}
+	}
+
+	// Adding a 4th dest should move roughly 1/4 of the keyspace, not the
+	// 3-out-of-4 a naive hash%len(dests) scheme would typically remap.
+	if frac := float64(remapped) / float64(numKeys); frac > 0.5 {
+		t.Errorf("remapped %d/%d keys (%.2f) when growing 3 dests to 4, want well under half", remapped, numKeys, frac)
+	}
+}
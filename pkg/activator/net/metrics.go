@@ -0,0 +1,149 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package activator
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Tag keys used to break down the measurements below by revision and by
+// what happened to the request.
+var (
+	namespaceTagKey = tag.MustNewKey("revision_namespace")
+	nameTagKey      = tag.MustNewKey("revision_name")
+	outcomeTagKey   = tag.MustNewKey("outcome")
+)
+
+// Outcome values for outcomeTagKey.
+const (
+	outcomeSuccess          = "success"
+	outcomeDeadlineExceeded = "deadline_exceeded"
+	outcomeRevisionNotFound = "revision_not_found"
+	outcomeError            = "error"
+)
+
+var (
+	tryLatencyM = stats.Float64(
+		"try_latency",
+		"The time spent in Throttler.Try, from call to the dest function returning",
+		stats.UnitMilliseconds)
+
+	queueDepthM = stats.Int64(
+		"queue_depth",
+		"The number of requests currently queued for or holding breaker capacity",
+		stats.UnitDimensionless)
+
+	breakerCapacityM = stats.Int64(
+		"breaker_capacity",
+		"The current concurrency capacity of a revision's breaker",
+		stats.UnitDimensionless)
+
+	retriesM = stats.Int64(
+		"retries",
+		"The number of retry attempts Throttler.Try made beyond the first",
+		stats.UnitDimensionless)
+)
+
+func registerMetricsViews() {
+	tagKeys := []tag.Key{namespaceTagKey, nameTagKey}
+	outcomeTagKeys := append([]tag.Key{outcomeTagKey}, tagKeys...)
+
+	views := []*view.View{{
+		Description: tryLatencyM.Description(),
+		Measure:     tryLatencyM,
+		Aggregation: view.Distribution(0, 1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000),
+		TagKeys:     outcomeTagKeys,
+	}, {
+		Description: queueDepthM.Description(),
+		Measure:     queueDepthM,
+		Aggregation: view.LastValue(),
+		TagKeys:     tagKeys,
+	}, {
+		Description: breakerCapacityM.Description(),
+		Measure:     breakerCapacityM,
+		Aggregation: view.LastValue(),
+		TagKeys:     tagKeys,
+	}, {
+		Description: retriesM.Description(),
+		Measure:     retriesM,
+		Aggregation: view.Count(),
+		TagKeys:     tagKeys,
+	}}
+	view.Register(views...)
+}
+
+func init() {
+	registerMetricsViews()
+}
+
+// revisionContext tags ctx with the revision's namespace and name without
+// disturbing its deadline/cancellation, so every measurement recorded
+// against it can be broken down per revision in Prometheus/StackDriver
+// without plumbing the name through every call site.
+func revisionContext(ctx context.Context, revID types.NamespacedName) context.Context {
+	tagged, err := tag.New(ctx,
+		tag.Upsert(namespaceTagKey, revID.Namespace),
+		tag.Upsert(nameTagKey, revID.Name))
+	if err != nil {
+		// Tag values here are always valid Kubernetes names, so this
+		// can't realistically fail; fall back to the untagged ctx rather
+		// than losing the measurement entirely.
+		return ctx
+	}
+	return tagged
+}
+
+func recordOutcome(ctx context.Context, startTime time.Time, outcome string) {
+	ctx, err := tag.New(ctx, tag.Upsert(outcomeTagKey, outcome))
+	if err != nil {
+		return
+	}
+	stats.Record(ctx, tryLatencyM.M(float64(time.Since(startTime))/float64(time.Millisecond)))
+}
+
+// recordQueueDepth records depth's current absolute value, not a delta:
+// the queue_depth view is aggregated with LastValue, which only ever
+// keeps the most recently recorded point, so every call here must carry
+// the true current in-flight count for the measurement to mean anything
+// under concurrency.
+func recordQueueDepth(ctx context.Context, depth int64) {
+	stats.Record(ctx, queueDepthM.M(depth))
+}
+
+func recordBreakerCapacity(ctx context.Context, capacity int) {
+	stats.Record(ctx, breakerCapacityM.M(int64(capacity)))
+}
+
+func recordRetry(ctx context.Context) {
+	stats.Record(ctx, retriesM.M(1))
+}
+
+// traceTry wraps fn in a span named name, a child of any span already in
+// ctx, so a single Try call's time is attributed across breaker
+// acquisition, dest selection, and the downstream call.
+func traceTry(ctx context.Context, name string, fn func(context.Context) error) error {
+	ctx, span := trace.StartSpan(ctx, name)
+	defer span.End()
+	return fn(ctx)
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package activator
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kubeinformers "k8s.io/client-go/informers"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"knative.dev/pkg/controller"
+	. "knative.dev/pkg/logging/testing"
+	"knative.dev/pkg/metrics/metricstest"
+	"knative.dev/serving/pkg/apis/networking"
+	servingfake "knative.dev/serving/pkg/client/clientset/versioned/fake"
+	servinginformers "knative.dev/serving/pkg/client/informers/externalversions"
+	"knative.dev/serving/pkg/queue"
+)
+
+// newMetricsTestThrottler sets up the same fixture the other throttler
+// tests use, returning a ready Throttler plus its revision id so the
+// caller can call Try. The caller is responsible for calling the
+// returned stop func once done, to tear down the informers.
+func newMetricsTestThrottler(t *testing.T) (throttler *Throttler, revID types.NamespacedName, stop func()) {
+	t.Helper()
+
+	params := queue.BreakerParams{
+		QueueDepth:      1,
+		MaxConcurrency:  defaultMaxConcurrency,
+		InitialCapacity: 0,
+	}
+
+	fake := kubefake.NewSimpleClientset()
+	informer := kubeinformers.NewSharedInformerFactory(fake, 0)
+	endpoints := informer.Core().V1().Endpoints()
+
+	servfake := servingfake.NewSimpleClientset()
+	servinginformer := servinginformers.NewSharedInformerFactory(servfake, 0)
+	revisions := servinginformer.Serving().V1alpha1().Revisions()
+
+	stopCh := make(chan struct{})
+	controller.StartInformers(stopCh, endpoints.Informer(), revisions.Informer())
+
+	revID = types.NamespacedName{Namespace: testNamespace, Name: testRevision}
+	rev := revision(revID, networking.ProtocolHTTP1)
+	servfake.ServingV1alpha1().Revisions(rev.Namespace).Create(rev)
+	revisions.Informer().GetIndexer().Add(rev)
+
+	throttler = NewThrottler(params, revisions, endpoints, TestLogger(t))
+
+	updateCh := make(chan RevisionDestsUpdate, 1)
+	updateCh <- RevisionDestsUpdate{Rev: revID, Dests: sets.NewString("128.0.0.1:1234")}
+	close(updateCh)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		throttler.Run(updateCh)
+	}()
+	wg.Wait()
+
+	return throttler, revID, func() { close(stopCh) }
+}
+
+func TestMetricsRecordedOnSuccess(t *testing.T) {
+	defer ClearAll()
+	throttler, revID, stop := newMetricsTestThrottler(t)
+	defer stop()
+
+	if err := throttler.Try(context.Background(), revID, func(string) error { return nil }); err != nil {
+		t.Fatalf("Try() = %v, want nil", err)
+	}
+
+	metricstest.CheckStatsReported(t, "try_latency", "breaker_capacity", "queue_depth")
+}
+
+// TestQueueDepthReflectsAbsoluteInFlightCount checks that queue_depth
+// carries the true current in-flight count rather than the raw +1/-1
+// delta recorded per call: the queue_depth view is aggregated with
+// LastValue, which just keeps the most recently recorded point, so a
+// delta only happens to look right when exactly one request is ever in
+// flight at a time.
+func TestQueueDepthReflectsAbsoluteInFlightCount(t *testing.T) {
+	defer ClearAll()
+	throttler, revID, stop := newMetricsTestThrottler(t)
+	defer stop()
+
+	wantTags := map[string]string{
+		"revision_namespace": testNamespace,
+		"revision_name":      testRevision,
+	}
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	go throttler.Try(context.Background(), revID, func(string) error {
+		close(entered)
+		<-release
+		return nil
+	})
+	<-entered
+	// Give the recordQueueDepth(..., 1) that Try made before invoking the
+	// function a moment to be aggregated before reading the view back.
+	time.Sleep(20 * time.Millisecond)
+	metricstest.CheckLastValueData(t, "queue_depth", wantTags, 1)
+
+	close(release)
+	time.Sleep(20 * time.Millisecond)
+	metricstest.CheckLastValueData(t, "queue_depth", wantTags, 0)
+}
+
+func TestMetricsRecordedOnDeadlineExceeded(t *testing.T) {
+	defer ClearAll()
+	throttler, revID, stop := newMetricsTestThrottler(t)
+	defer stop()
+
+	// Occupy the only slot so a second request can't get in before its
+	// context expires.
+	release := make(chan struct{})
+	go throttler.Try(context.Background(), revID, func(string) error {
+		<-release
+		return nil
+	})
+	time.Sleep(50 * time.Millisecond)
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := throttler.Try(ctx, revID, func(string) error { return nil })
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Try() = %v, want context.DeadlineExceeded", err)
+	}
+
+	metricstest.CheckStatsReported(t, "try_latency")
+}
+
+func TestMetricsRecordedOnRevisionNotFound(t *testing.T) {
+	defer ClearAll()
+	throttler, _, stop := newMetricsTestThrottler(t)
+	defer stop()
+
+	missing := types.NamespacedName{Namespace: testNamespace, Name: "does-not-exist"}
+	err := throttler.Try(context.Background(), missing, func(string) error { return nil })
+	if err == nil {
+		t.Fatal("Try() = nil, want an error for an unknown revision")
+	}
+	if got := outcomeFor(err); got != outcomeRevisionNotFound {
+		t.Errorf("outcomeFor(%v) = %s, want %s", err, got, outcomeRevisionNotFound)
+	}
+
+	metricstest.CheckStatsReported(t, "try_latency")
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package activator
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy configures how Throttler.Try behaves when it can't
+// immediately acquire breaker capacity for a revision. The zero value
+// disables retries, preserving the throttler's original behavior of
+// failing with ctx.Err() as soon as the context is done.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of times Try will attempt to
+	// acquire capacity, including the first attempt. A value <= 1
+	// disables retries.
+	MaxAttempts int
+
+	// InitialBackoff is the base delay before the first retry. Each
+	// subsequent retry doubles it, capped at MaxBackoff, and every delay
+	// is jittered via full jitter (a uniform random duration in
+	// [0, backoff)) to avoid retry storms across concurrent callers.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the exponential backoff growth.
+	MaxBackoff time.Duration
+
+	// HedgeAfter, if non-zero, causes Try's final attempt to additionally
+	// fire a second, independent acquisition attempt -- typically landing
+	// on a different dest thanks to the LoadBalancer -- if that attempt
+	// hasn't finished within this duration. Earlier attempts are not
+	// hedged, and HedgeAfter has no effect unless MaxAttempts > 1. The
+	// attempt that first gets to invoke the function wins, and its result,
+	// success or error, is returned; the other is cancelled.
+	HedgeAfter time.Duration
+}
+
+// defaultRetryPolicy preserves the throttler's original behavior: a
+// single attempt, no backoff, no hedging.
+var defaultRetryPolicy = RetryPolicy{MaxAttempts: 1}
+
+// enabled reports whether the policy actually requests retries.
+func (p RetryPolicy) enabled() bool {
+	return p.MaxAttempts > 1
+}
+
+// backoffFor returns the full-jitter backoff duration to wait before the
+// given 1-indexed retry attempt (attempt 2 is the first retry).
+func (p RetryPolicy) backoffFor(attempt int) time.Duration {
+	backoff := p.InitialBackoff << uint(attempt-2)
+	if backoff <= 0 || (p.MaxBackoff > 0 && backoff > p.MaxBackoff) {
+		backoff = p.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
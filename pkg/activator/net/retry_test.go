@@ -0,0 +1,228 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package activator
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	. "knative.dev/pkg/logging/testing"
+	"knative.dev/serving/pkg/queue"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 4, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 100 * time.Millisecond}
+	if p.enabled() != true {
+		t.Error("enabled() = false, want true for MaxAttempts > 1")
+	}
+	if (RetryPolicy{MaxAttempts: 1}).enabled() {
+		t.Error("enabled() = true, want false for MaxAttempts <= 1")
+	}
+
+	for attempt := 2; attempt <= 6; attempt++ {
+		backoff := p.backoffFor(attempt)
+		if backoff < 0 || backoff > p.MaxBackoff {
+			t.Errorf("backoffFor(%d) = %v, want in [0, %v]", attempt, backoff, p.MaxBackoff)
+		}
+	}
+}
+
+// newFullBreaker returns a breaker whose QueueDepth+MaxConcurrency slots
+// are all occupied by blocked callers, so the next Maybe call genuinely
+// fails fast with ErrRequestQueueFull rather than waiting on ctx -- unlike
+// a breaker that's merely at zero capacity, which Maybe blocks on until
+// ctx is done rather than failing immediately. The returned stop func
+// cancels the blockers' ctx, ending any of their Maybe calls still waiting.
+func newFullBreaker(t *testing.T, queueDepth, maxConcurrency int32) (b breaker, stop func()) {
+	t.Helper()
+	b = queue.NewBreaker(queue.BreakerParams{
+		QueueDepth:      queueDepth,
+		MaxConcurrency:  maxConcurrency,
+		InitialCapacity: 0,
+	})
+
+	totalSlots := int(queueDepth + maxConcurrency)
+	ctx, cancel := context.WithCancel(context.Background())
+	var started sync.WaitGroup
+	started.Add(totalSlots)
+	for i := 0; i < totalSlots; i++ {
+		go func() {
+			started.Done()
+			b.Maybe(ctx, func() {})
+		}()
+	}
+	started.Wait()
+	// Give the blockers a moment to have actually reached sem.acquire
+	// (claimed their pendingRequests slot) before the caller proceeds.
+	time.Sleep(20 * time.Millisecond)
+	return b, cancel
+}
+
+// TestThrottlerRetriesAfterQueueFull exercises the actual retry/backoff
+// path: with the breaker's queue genuinely full, the first attempt fails
+// fast with a non-ctx error (ErrRequestQueueFull), and only a retry,
+// after backoff, succeeds once capacity is granted and the blockers
+// holding the queue release it. With retries disabled (MaxAttempts: 1)
+// the same setup fails, proving the success case above genuinely depends
+// on the retry loop rather than breaker.Maybe blocking until ctx is done.
+func TestThrottlerRetriesAfterQueueFull(t *testing.T) {
+	defer ClearAll()
+	revID := types.NamespacedName{Namespace: testNamespace, Name: testRevision}
+
+	newThrottler := func(policy RetryPolicy) (*Throttler, breaker, func()) {
+		b, stop := newFullBreaker(t, 1, 2)
+		rt := &revisionThrottler{
+			revID:                revID,
+			containerConcurrency: 1,
+			breaker:              b,
+			dests:                sets.NewString("128.0.0.1:1234"),
+			lb:                   newRoundRobinLoadBalancer(),
+		}
+		th := &Throttler{
+			revisionThrottlers: map[types.NamespacedName]*revisionThrottler{revID: rt},
+			logger:             TestLogger(t),
+			retryPolicy:        policy,
+		}
+		return th, b, stop
+	}
+
+	t.Run("without retries, a full queue fails immediately", func(t *testing.T) {
+		th, _, stop := newThrottler(RetryPolicy{MaxAttempts: 1})
+		defer stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if err := th.Try(ctx, revID, func(string) error { return nil }); err == nil {
+			t.Error("Try() = nil, want an error since the queue is full and retries are disabled")
+		}
+	})
+
+	t.Run("with retries, a full queue eventually succeeds once capacity is granted", func(t *testing.T) {
+		th, b, stop := newThrottler(RetryPolicy{
+			MaxAttempts:    20,
+			InitialBackoff: 10 * time.Millisecond,
+			MaxBackoff:     20 * time.Millisecond,
+		})
+		defer stop()
+
+		// Capacity arrives 50ms in: the blockers occupying the queue can
+		// now complete, freeing it up for a retried attempt to land.
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			b.UpdateConcurrency(3)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		var got string
+		err := th.Try(ctx, revID, func(dest string) error {
+			got = dest
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Try() = %v, want success once the queue frees up", err)
+		}
+		if got != "128.0.0.1:1234" {
+			t.Errorf("Try() routed to %s, want 128.0.0.1:1234", got)
+		}
+	})
+}
+
+func TestTryWithHedgeReturnsFirstWinner(t *testing.T) {
+	rt := &revisionThrottler{
+		revID:   types.NamespacedName{Namespace: testNamespace, Name: testRevision},
+		breaker: NewInfiniteBreaker(TestLogger(t)),
+		dests:   sets.NewString("10.0.0.1:8012"),
+		lb:      newRoundRobinLoadBalancer(),
+	}
+	rt.breaker.(*InfiniteBreaker).UpdateConcurrency(1)
+
+	var calls int32
+	var mu sync.Mutex
+	err := tryWithHedge(context.Background(), rt, "", func(dest string) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return nil
+	}, 5*time.Millisecond)
+
+	if err != nil {
+		t.Fatalf("tryWithHedge() = %v, want nil", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls == 0 {
+		t.Error("expected at least one attempt to invoke the function")
+	}
+}
+
+// TestTryWithHedgeInvokesFunctionAtMostOnce exercises the actual race the
+// earlier test missed: the breaker here is an InfiniteBreaker, which
+// admits callers unconditionally, so once the hedge fires it is admitted
+// concurrently with the still-running original attempt. The only thing
+// standing between that and a real double side effect is the winnerID
+// fence in tryWithHedge.
+func TestTryWithHedgeInvokesFunctionAtMostOnce(t *testing.T) {
+	rt := &revisionThrottler{
+		revID:   types.NamespacedName{Namespace: testNamespace, Name: testRevision},
+		breaker: NewInfiniteBreaker(TestLogger(t)),
+		dests:   sets.NewString("10.0.0.1:8012"),
+		lb:      newRoundRobinLoadBalancer(),
+	}
+	rt.breaker.(*InfiniteBreaker).UpdateConcurrency(1)
+
+	var calls int32
+	unblock := make(chan struct{})
+	started := make(chan struct{})
+	var startedOnce sync.Once
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tryWithHedge(context.Background(), rt, "", func(dest string) error {
+			atomic.AddInt32(&calls, 1)
+			startedOnce.Do(func() { close(started) })
+			<-unblock
+			return nil
+		}, 5*time.Millisecond)
+	}()
+
+	<-started
+	// Give the hedge time to fire and race a second admission in while
+	// the first call is still blocked.
+	time.Sleep(20 * time.Millisecond)
+	close(unblock)
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("tryWithHedge() = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("tryWithHedge() did not return")
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("function invoked %d times, want exactly 1", got)
+	}
+}
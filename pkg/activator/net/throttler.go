@@ -0,0 +1,676 @@
+/*
+Copyright 2019 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package activator contains the Throttler, which keeps track of the
+// healthy dests for every active Revision and gates concurrent requests
+// to them via a per-revision breaker.
+package activator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/trace"
+	"go.uber.org/zap"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+
+	corev1informers "k8s.io/client-go/informers/core/v1"
+
+	"knative.dev/pkg/system"
+	"knative.dev/serving/pkg/apis/networking"
+	"knative.dev/serving/pkg/apis/serving/v1alpha1"
+	servinginformers "knative.dev/serving/pkg/client/informers/externalversions/serving/v1alpha1"
+	servinglisters "knative.dev/serving/pkg/client/listers/serving/v1alpha1"
+	"knative.dev/serving/pkg/queue"
+)
+
+// RevisionDestsUpdate carries the current set of healthy dests for a
+// revision, as computed by the activator's endpoints informer handlers.
+// An empty ClusterIPDest means there is no shared ClusterIP in play yet
+// (e.g. the K8s Service hasn't settled) and per-pod dests should be used.
+type RevisionDestsUpdate struct {
+	Rev           types.NamespacedName
+	ClusterIPDest string
+	Dests         sets.String
+}
+
+// revisionThrottler tracks the state the Throttler needs to route
+// requests for a single revision: its breaker (which gates concurrency),
+// the currently known dests, and the LoadBalancer used to choose among
+// them.
+type revisionThrottler struct {
+	revID                types.NamespacedName
+	containerConcurrency int
+	breaker              breaker
+	logger               *zap.SugaredLogger
+
+	// extendedResourceBound is true when the revision's user container
+	// requests an extended resource (e.g. nvidia.com/gpu) in addition to
+	// the standard cpu/memory/ephemeral-storage trio. Such resources are
+	// typically not safely shareable the way CPU time-slicing is, so
+	// updateCapacity treats these revisions as effectively single-
+	// concurrency per pod regardless of their declared
+	// containerConcurrency.
+	extendedResourceBound bool
+
+	// queueDepth is the number of Try calls for this revision currently
+	// queued or in flight. It's updated atomically so recordQueueDepth can
+	// report its true current value rather than a per-call delta that a
+	// LastValue-aggregated view can't meaningfully combine across calls.
+	queueDepth int64
+
+	mux           sync.RWMutex
+	clusterIPDest string
+	dests         sets.String
+	lb            LoadBalancer
+}
+
+func (rt *revisionThrottler) incQueueDepth() int64 {
+	return atomic.AddInt64(&rt.queueDepth, 1)
+}
+
+func (rt *revisionThrottler) decQueueDepth() int64 {
+	return atomic.AddInt64(&rt.queueDepth, -1)
+}
+
+// handleUpdate records the new dests/ClusterIP and returns the resulting
+// dest count, so the caller can recompute capacity (which may depend on
+// state, like leader-election grants, that only the Throttler knows about).
+func (rt *revisionThrottler) handleUpdate(update RevisionDestsUpdate) int {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	rt.clusterIPDest = update.ClusterIPDest
+	rt.dests = update.Dests
+	return rt.dests.Len()
+}
+
+// updateCapacity divides this revision's total concurrency evenly across
+// the currently known activators, so that with N activators sharing the
+// dests for a revision, each admits roughly 1/N of its capacity. This
+// statically assumes every activator is symmetric; see LBPolicy docs for
+// per-pod-IP routing, which this division is orthogonal to.
+func (rt *revisionThrottler) updateCapacity(numDests, numActivators int) {
+	if _, ok := rt.breaker.(*InfiniteBreaker); ok {
+		// The infinite breaker only cares whether at least one dest exists.
+		if numDests > 0 {
+			rt.breaker.UpdateConcurrency(1)
+		} else {
+			rt.breaker.UpdateConcurrency(0)
+		}
+		return
+	}
+
+	if numActivators < 1 {
+		numActivators = 1
+	}
+	concurrency := rt.containerConcurrency
+	if rt.extendedResourceBound && concurrency > 1 {
+		concurrency = 1
+	}
+	capacity := concurrency * numDests / numActivators
+	if capacity < 1 && numDests > 0 {
+		capacity = 1
+	}
+	rt.breaker.UpdateConcurrency(capacity)
+}
+
+// extendedResourceBound reports whether container requests an extended
+// resource (e.g. nvidia.com/gpu) beyond the standard cpu/memory/
+// ephemeral-storage trio. See revisionThrottler.extendedResourceBound.
+func extendedResourceBound(container *corev1.Container) bool {
+	if container == nil {
+		return false
+	}
+	for name := range container.Resources.Requests {
+		switch name {
+		case corev1.ResourceCPU, corev1.ResourceMemory, corev1.ResourceEphemeralStorage:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// pick returns a dest (and its release func) honoring the ClusterIP
+// override: when the Service's ClusterIP is ready we always route there,
+// since it fans out to pods via kube-proxy on its own; LoadBalancer
+// policies only apply to direct pod-IP dests.
+func (rt *revisionThrottler) pick(key string) (string, func(), error) {
+	rt.mux.RLock()
+	clusterIP := rt.clusterIPDest
+	dests := rt.dests
+	lb := rt.lb
+	rt.mux.RUnlock()
+
+	if clusterIP != "" {
+		return clusterIP, noopRelease, nil
+	}
+	if dests.Len() == 0 {
+		return "", nil, fmt.Errorf("revision %s/%s has no ready dests", rt.revID.Namespace, rt.revID.Name)
+	}
+
+	if key != "" {
+		if klb, ok := lb.(keyedLoadBalancer); ok {
+			dest, release := klb.PickForKey(dests, rt.revID, key)
+			return dest, release, nil
+		}
+	}
+	dest, release := lb.Pick(dests, rt.revID)
+	return dest, release, nil
+}
+
+// Throttler keeps track of the number of in-flight requests for each
+// revision it knows about, and gates incoming requests so no revision
+// exceeds its container concurrency.
+type Throttler struct {
+	revisionThrottlers      map[types.NamespacedName]*revisionThrottler
+	revisionThrottlersMutex sync.RWMutex
+
+	revisionLister servinglisters.RevisionLister
+
+	numActivatorsMux sync.RWMutex
+	numActivators    int
+	activatorIDs     sets.String
+
+	breakerParams queue.BreakerParams
+	retryPolicy   RetryPolicy
+	coordinator   *coordinator
+	logger        *zap.SugaredLogger
+}
+
+// WithCoordinator turns on leader-elected capacity coordination: see
+// CoordinatorConfig for what that buys over the static division. The
+// election loop and the slot-grants ConfigMap informer both run for the
+// lifetime of the process.
+func WithCoordinator(cfg CoordinatorConfig, client kubernetes.Interface, logger *zap.SugaredLogger) ThrottlerOption {
+	return func(t *Throttler) {
+		if !cfg.Enabled {
+			return
+		}
+		t.coordinator = newCoordinator(cfg, client, logger)
+		go t.coordinator.run(context.Background())
+
+		factory := kubeinformers.NewSharedInformerFactoryWithOptions(client, 0, kubeinformers.WithNamespace(system.Namespace()))
+		configMaps := factory.Core().V1().ConfigMaps()
+		configMaps.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: func(obj interface{}) bool {
+				cm := asConfigMap(obj)
+				return cm != nil && cm.Name == slotGrantsConfigMapName
+			},
+			Handler: cache.ResourceEventHandlerFuncs{
+				AddFunc: func(obj interface{}) { t.coordinator.onConfigMapUpdate(asConfigMap(obj)) },
+				UpdateFunc: func(_, newObj interface{}) {
+					t.coordinator.onConfigMapUpdate(asConfigMap(newObj))
+				},
+			},
+		})
+		// Never closed: the informer runs for the lifetime of the process,
+		// same as the leader-election loop started above.
+		factory.Start(make(chan struct{}))
+	}
+}
+
+func asConfigMap(obj interface{}) *corev1.ConfigMap {
+	if cm, ok := obj.(*corev1.ConfigMap); ok {
+		return cm
+	}
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		cm, _ := tombstone.Obj.(*corev1.ConfigMap)
+		return cm
+	}
+	return nil
+}
+
+// ThrottlerOption customizes a Throttler at construction time. Keeping
+// these as options rather than NewThrottler params lets us add knobs
+// (like RetryPolicy) without breaking existing callers.
+type ThrottlerOption func(*Throttler)
+
+// WithRetryPolicy configures how Try behaves when breaker capacity isn't
+// immediately available. Without this option, Try fails as soon as its
+// ctx is done, matching the throttler's original behavior.
+func WithRetryPolicy(policy RetryPolicy) ThrottlerOption {
+	return func(t *Throttler) {
+		t.retryPolicy = policy
+	}
+}
+
+// NewThrottler creates a new Throttler for the given breaker
+// configuration, wired to the revision and endpoints informers so it can
+// look up container concurrency, react to revision deletion, and learn
+// how many activator replicas are currently sharing the load.
+func NewThrottler(
+	breakerParams queue.BreakerParams,
+	revisions servinginformers.RevisionInformer,
+	endpoints corev1informers.EndpointsInformer,
+	logger *zap.SugaredLogger,
+	opts ...ThrottlerOption) *Throttler {
+	t := &Throttler{
+		revisionThrottlers: make(map[types.NamespacedName]*revisionThrottler),
+		revisionLister:     revisions.Lister(),
+		numActivators:      1,
+		breakerParams:      breakerParams,
+		retryPolicy:        defaultRetryPolicy,
+		logger:             logger,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	revisions.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: t.revisionDeleted,
+	})
+	endpoints.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			ep := asEndpoints(obj)
+			return ep != nil && ep.Namespace == system.Namespace() && ep.Name == networking.ActivatorServiceName
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc:    t.updateActivatorCount,
+			UpdateFunc: func(_, newObj interface{}) { t.updateActivatorCount(newObj) },
+			DeleteFunc: t.updateActivatorCount,
+		},
+	})
+	return t
+}
+
+func asEndpoints(obj interface{}) *corev1.Endpoints {
+	if ep, ok := obj.(*corev1.Endpoints); ok {
+		return ep
+	}
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		ep, _ := tombstone.Obj.(*corev1.Endpoints)
+		return ep
+	}
+	return nil
+}
+
+// updateActivatorCount recomputes the set of ready activator endpoints
+// and propagates the new count to every known revision so each gets its
+// fair, evenly-divided share of capacity.
+func (t *Throttler) updateActivatorCount(obj interface{}) {
+	ids := sets.NewString()
+	if ep := asEndpoints(obj); ep != nil {
+		for _, subset := range ep.Subsets {
+			for _, addr := range subset.Addresses {
+				ids.Insert(addr.IP)
+			}
+		}
+	}
+	num := ids.Len()
+	if num < 1 {
+		num = 1
+	}
+
+	t.numActivatorsMux.Lock()
+	t.numActivators = num
+	t.activatorIDs = ids
+	t.numActivatorsMux.Unlock()
+
+	t.revisionThrottlersMutex.RLock()
+	defer t.revisionThrottlersMutex.RUnlock()
+	for _, rt := range t.revisionThrottlers {
+		rt.mux.RLock()
+		numDests := rt.dests.Len()
+		rt.mux.RUnlock()
+		t.applyCapacity(rt, numDests, num)
+		t.publishGrantsIfLeader(rt, numDests, ids)
+	}
+}
+
+// applyCapacity decides rt's new breaker capacity for the given dest/
+// activator counts, preferring a leader-published grant when leader
+// election coordination is enabled and a grant has arrived, and falling
+// back to the static even division otherwise (e.g. during startup before
+// the first grant is published, or when coordination is off).
+func (t *Throttler) applyCapacity(rt *revisionThrottler, numDests, numActivators int) {
+	if t.coordinator != nil {
+		if capacity, ok := t.coordinator.grantFor(rt.revID); ok {
+			if _, isInfinite := rt.breaker.(*InfiniteBreaker); isInfinite {
+				rt.updateCapacity(numDests, numActivators)
+				return
+			}
+			rt.breaker.UpdateConcurrency(capacity)
+			return
+		}
+	}
+	rt.updateCapacity(numDests, numActivators)
+}
+
+// publishGrantsIfLeader is a no-op unless coordination is on and this
+// replica is currently the elected leader. When it is, it splits rt's
+// total capacity (containerConcurrency times numDests, with the same
+// extended-resource cap updateCapacity applies) across the known
+// activators, handing any remainder out one slot at a time in sorted
+// activator-ID order rather than dropping it the way the static even
+// division does, and publishes each share as that activator's grant, so
+// the whole fleet converges on one
+// authoritative value instead of each replica racing its own endpoints-
+// informer view. Capacity-aware per-activator splits (e.g. accounting for
+// pod-IP routing skew) are future work; this establishes the publish/
+// consume path the rest of that work will build on.
+func (t *Throttler) publishGrantsIfLeader(rt *revisionThrottler, numDests int, activatorIDs sets.String) {
+	if t.coordinator == nil || !t.coordinator.amLeader() {
+		return
+	}
+	if _, isInfinite := rt.breaker.(*InfiniteBreaker); isInfinite {
+		return
+	}
+
+	numActivators := activatorIDs.Len()
+	if numActivators < 1 {
+		numActivators = 1
+	}
+	concurrency := rt.containerConcurrency
+	if rt.extendedResourceBound && concurrency > 1 {
+		concurrency = 1
+	}
+	total := concurrency * numDests
+	base, remainder := total/numActivators, total%numActivators
+
+	for i, id := range activatorIDs.List() {
+		capacity := base
+		if i < remainder {
+			capacity++
+		}
+		if capacity < 1 && numDests > 0 {
+			capacity = 1
+		}
+		if err := t.coordinator.publishGrant(rt.revID, id, capacity); err != nil {
+			t.logger.Errorw("Failed to publish slot grant", zap.Error(err), "revision", rt.revID, "activator", id)
+		}
+	}
+}
+
+func (t *Throttler) currentActivatorCount() int {
+	t.numActivatorsMux.RLock()
+	defer t.numActivatorsMux.RUnlock()
+	return t.numActivators
+}
+
+func (t *Throttler) currentActivatorIDs() sets.String {
+	t.numActivatorsMux.RLock()
+	defer t.numActivatorsMux.RUnlock()
+	return t.activatorIDs
+}
+
+// revisionDeleted drops all throttler state for a deleted revision so
+// in-flight Try calls for it fail fast instead of routing to stale dests.
+func (t *Throttler) revisionDeleted(obj interface{}) {
+	rev, ok := obj.(*v1alpha1.Revision)
+	if !ok {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			rev, ok = tombstone.Obj.(*v1alpha1.Revision)
+			if !ok {
+				return
+			}
+		} else {
+			return
+		}
+	}
+
+	revID := types.NamespacedName{Namespace: rev.Namespace, Name: rev.Name}
+	t.revisionThrottlersMutex.Lock()
+	defer t.revisionThrottlersMutex.Unlock()
+	delete(t.revisionThrottlers, revID)
+}
+
+func (t *Throttler) getOrCreateRevisionThrottler(revID types.NamespacedName) (*revisionThrottler, error) {
+	t.revisionThrottlersMutex.RLock()
+	rt, ok := t.revisionThrottlers[revID]
+	t.revisionThrottlersMutex.RUnlock()
+	if ok {
+		return rt, nil
+	}
+
+	rev, err := t.revisionLister.Revisions(revID.Namespace).Get(revID.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	t.revisionThrottlersMutex.Lock()
+	defer t.revisionThrottlersMutex.Unlock()
+	if rt, ok := t.revisionThrottlers[revID]; ok {
+		return rt, nil
+	}
+
+	cc := int(rev.Spec.GetContainerConcurrency())
+	var b breaker
+	if cc == 0 {
+		b = NewInfiniteBreaker(t.logger)
+	} else {
+		b = queue.NewBreaker(t.breakerParams)
+	}
+
+	container := rev.Spec.DeprecatedContainer
+	if container == nil && len(rev.Spec.Containers) > 0 {
+		container = &rev.Spec.Containers[0]
+	}
+
+	rt = &revisionThrottler{
+		revID:                 revID,
+		containerConcurrency:  cc,
+		breaker:               b,
+		logger:                t.logger,
+		dests:                 sets.NewString(),
+		lb:                    newLoadBalancer(rev.ObjectMeta.Annotations[LBPolicyAnnotationKey]),
+		extendedResourceBound: extendedResourceBound(container),
+	}
+	t.revisionThrottlers[revID] = rt
+	return rt, nil
+}
+
+// Run starts processing dest updates off of updateCh until it is closed.
+func (t *Throttler) Run(updateCh <-chan RevisionDestsUpdate) {
+	for update := range updateCh {
+		rt, err := t.getOrCreateRevisionThrottler(update.Rev)
+		if err != nil {
+			t.logger.Errorw("Failed to get revision throttler", zap.Error(err))
+			continue
+		}
+		numDests := rt.handleUpdate(update)
+		t.applyCapacity(rt, numDests, t.currentActivatorCount())
+		t.publishGrantsIfLeader(rt, numDests, t.currentActivatorIDs())
+	}
+}
+
+// Try picks a dest for revID, gated by that revision's breaker, and
+// invokes function with it. If the breaker's capacity isn't available
+// before ctx is done, Try returns ctx.Err(). Try supplies no routing key,
+// so key-aware LoadBalancer policies fall back to their keyless Pick; use
+// TryWithKey to pick a sticky dest.
+func (t *Throttler) Try(ctx context.Context, revID types.NamespacedName, function func(string) error) error {
+	return t.TryWithKey(ctx, revID, "", function)
+}
+
+// TryWithKey is Try plus an explicit routing key, typically lifted from
+// a request header by the caller (e.g. activator's handler).
+func (t *Throttler) TryWithKey(ctx context.Context, revID types.NamespacedName, key string, function func(string) error) error {
+	ctx = revisionContext(ctx, revID)
+	startTime := time.Now()
+
+	err := t.tryWithKey(ctx, revID, key, function)
+	recordOutcome(ctx, startTime, outcomeFor(err))
+	return err
+}
+
+func outcomeFor(err error) string {
+	switch {
+	case err == nil:
+		return outcomeSuccess
+	case err == context.DeadlineExceeded:
+		return outcomeDeadlineExceeded
+	case apierrors.IsNotFound(err):
+		return outcomeRevisionNotFound
+	default:
+		return outcomeError
+	}
+}
+
+// tryWithKey assumes ctx is already tagged with the revision (see
+// revisionContext) so all the stats it records land on the right series.
+func (t *Throttler) tryWithKey(ctx context.Context, revID types.NamespacedName, key string, function func(string) error) error {
+	rt, err := t.getOrCreateRevisionThrottler(revID)
+	if err != nil {
+		return err
+	}
+	recordBreakerCapacity(ctx, rt.breaker.Capacity())
+
+	recordQueueDepth(ctx, rt.incQueueDepth())
+	defer func() { recordQueueDepth(ctx, rt.decQueueDepth()) }()
+
+	policy := t.retryPolicy
+	if !policy.enabled() {
+		return traceTry(ctx, "throttler_try", func(ctx context.Context) error {
+			return tryOnce(ctx, rt, key, function)
+		})
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			recordRetry(ctx)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(policy.backoffFor(attempt)):
+			}
+		}
+
+		var err error
+		spanName := "throttler_try"
+		if policy.HedgeAfter > 0 && attempt == policy.MaxAttempts {
+			// Hedge only the final attempt: by then a stuck pick is the
+			// most likely explanation, so it's worth racing a second one.
+			spanName = "throttler_try_hedged"
+			err = traceTry(ctx, spanName, func(ctx context.Context) error {
+				return tryWithHedge(ctx, rt, key, function, policy.HedgeAfter)
+			})
+		} else {
+			err = traceTry(ctx, spanName, func(ctx context.Context) error {
+				return tryOnce(ctx, rt, key, function)
+			})
+		}
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return lastErr
+}
+
+// tryOnce makes a single capacity-gated attempt to route revID, blocking
+// until ctx is done or the breaker admits the request, unless the breaker
+// rejects it outright (e.g. with a full queue).
+func tryOnce(ctx context.Context, rt *revisionThrottler, key string, function func(string) error) error {
+	_, acquireSpan := trace.StartSpan(ctx, "throttler_try/breaker_acquire")
+	var endAcquireOnce sync.Once
+	endAcquire := func() { endAcquireOnce.Do(acquireSpan.End) }
+
+	var funcErr error
+	err := rt.breaker.Maybe(ctx, func() {
+		endAcquire()
+
+		_, pickSpan := trace.StartSpan(ctx, "throttler_try/pick_dest")
+		dest, release, pickErr := rt.pick(key)
+		pickSpan.End()
+		if pickErr != nil {
+			funcErr = pickErr
+			return
+		}
+		defer release()
+
+		_, callSpan := trace.StartSpan(ctx, "throttler_try/downstream_call")
+		defer callSpan.End()
+		funcErr = function(dest)
+	})
+	endAcquire()
+	if err != nil {
+		return err
+	}
+	return funcErr
+}
+
+// errHedgeSuperseded is returned internally by whichever hedged attempt
+// loses the race to actually invoke the caller's function. It never
+// escapes tryWithHedge: the other attempt's result is authoritative
+// whenever this one shows up.
+var errHedgeSuperseded = errors.New("throttler: hedge attempt superseded")
+
+// tryWithHedge races a second tryOnce call against the first, starting it
+// only if the first hasn't finished after hedgeAfter. Cancelling the
+// loser's ctx alone isn't enough to keep it from calling function: the
+// breaker may have already admitted it before cancellation lands. So both
+// attempts share a winnerID fence that guarantees function is invoked at
+// most once even if both get admitted concurrently -- the loser observes
+// errHedgeSuperseded instead of calling function a second time. Whichever
+// attempt actually fired is authoritative; its result (success or error)
+// is what tryWithHedge returns.
+func tryWithHedge(ctx context.Context, rt *revisionThrottler, key string, function func(string) error, hedgeAfter time.Duration) error {
+	hedgeCtx, cancelHedge := context.WithCancel(ctx)
+	defer cancelHedge()
+
+	var winnerID int32 = -1
+	fenced := func(id int32) func(string) error {
+		return func(dest string) error {
+			if !atomic.CompareAndSwapInt32(&winnerID, -1, id) {
+				return errHedgeSuperseded
+			}
+			return function(dest)
+		}
+	}
+
+	type result struct {
+		id  int32
+		err error
+	}
+	resCh := make(chan result, 2)
+	attempt := func(id int32) {
+		resCh <- result{id, tryOnce(hedgeCtx, rt, key, fenced(id))}
+	}
+
+	go attempt(0)
+
+	select {
+	case res := <-resCh:
+		return res.err
+	case <-time.After(hedgeAfter):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	go attempt(1)
+
+	first := <-resCh
+	if first.err != errHedgeSuperseded {
+		return first.err
+	}
+	second := <-resCh
+	return second.err
+}
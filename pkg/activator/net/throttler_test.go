@@ -24,6 +24,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/sets"
@@ -459,3 +460,199 @@ func TestInfiniteBreaker(t *testing.T) {
 		t.Error("thunk was not invoked")
 	}
 }
+
+// TestRevisionLBPolicyAnnotationWiring asserts that getOrCreateRevisionThrottler
+// actually wires a revisionThrottler's LoadBalancer from the Revision's
+// LBPolicyAnnotationKey annotation, not just that newLoadBalancer maps
+// policy strings correctly in isolation (see lb_test.go).
+func TestRevisionLBPolicyAnnotationWiring(t *testing.T) {
+	defer ClearAll()
+	fake := kubefake.NewSimpleClientset()
+	informer := kubeinformers.NewSharedInformerFactory(fake, 0)
+	endpoints := informer.Core().V1().Endpoints()
+
+	servfake := servingfake.NewSimpleClientset()
+	servinginformer := servinginformers.NewSharedInformerFactory(servfake, 0)
+	revisions := servinginformer.Serving().V1alpha1().Revisions()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	controller.StartInformers(stopCh, endpoints.Informer(), revisions.Informer())
+
+	revID := types.NamespacedName{Namespace: testNamespace, Name: testRevision}
+	rev := revisionWithAnnotations(revID, networking.ProtocolHTTP1, map[string]string{
+		LBPolicyAnnotationKey: LBPolicyConsistentHash,
+	})
+	servfake.ServingV1alpha1().Revisions(rev.Namespace).Create(rev)
+	revisions.Informer().GetIndexer().Add(rev)
+
+	params := queue.BreakerParams{QueueDepth: 1, MaxConcurrency: defaultMaxConcurrency, InitialCapacity: 0}
+	throttler := NewThrottler(params, revisions, endpoints, TestLogger(t))
+
+	rt, err := throttler.getOrCreateRevisionThrottler(revID)
+	if err != nil {
+		t.Fatalf("getOrCreateRevisionThrottler() = %v", err)
+	}
+	if _, ok := rt.lb.(*consistentHashLoadBalancer); !ok {
+		t.Errorf("rt.lb = %T, want *consistentHashLoadBalancer", rt.lb)
+	}
+}
+
+// TestClusterIPOverridesAnnotatedLBPolicy asserts that a ClusterIPDest
+// still wins pick() even when the revision has configured a non-default
+// LoadBalancer policy via annotation: ClusterIPDest fans out to pods via
+// kube-proxy on its own, so LoadBalancer policies never get a chance to
+// run once it's set, regardless of which policy is configured.
+func TestClusterIPOverridesAnnotatedLBPolicy(t *testing.T) {
+	defer ClearAll()
+	fake := kubefake.NewSimpleClientset()
+	informer := kubeinformers.NewSharedInformerFactory(fake, 0)
+	endpoints := informer.Core().V1().Endpoints()
+
+	servfake := servingfake.NewSimpleClientset()
+	servinginformer := servinginformers.NewSharedInformerFactory(servfake, 0)
+	revisions := servinginformer.Serving().V1alpha1().Revisions()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	controller.StartInformers(stopCh, endpoints.Informer(), revisions.Informer())
+
+	revID := types.NamespacedName{Namespace: testNamespace, Name: testRevision}
+	rev := revisionWithAnnotations(revID, networking.ProtocolHTTP1, map[string]string{
+		LBPolicyAnnotationKey: LBPolicyConsistentHash,
+	})
+	servfake.ServingV1alpha1().Revisions(rev.Namespace).Create(rev)
+	revisions.Informer().GetIndexer().Add(rev)
+
+	params := queue.BreakerParams{QueueDepth: 1, MaxConcurrency: defaultMaxConcurrency, InitialCapacity: 0}
+	throttler := NewThrottler(params, revisions, endpoints, TestLogger(t))
+
+	updateCh := make(chan RevisionDestsUpdate, 1)
+	updateCh <- RevisionDestsUpdate{
+		Rev:           revID,
+		ClusterIPDest: "129.0.0.1:1234",
+		Dests:         sets.NewString("128.0.0.1:1234", "128.0.0.2:1234"),
+	}
+	close(updateCh)
+	throttler.Run(updateCh)
+
+	// Try repeatedly with distinct keys: a consistent-hash policy would
+	// otherwise spread these across the pod dests, but ClusterIPDest must
+	// win every time.
+	for _, key := range []string{"key-a", "key-b", "key-c"} {
+		tryContext, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err := throttler.TryWithKey(tryContext, revID, key, func(dest string) error {
+			if dest != "129.0.0.1:1234" {
+				t.Errorf("dest = %s, want ClusterIPDest 129.0.0.1:1234", dest)
+			}
+			return nil
+		})
+		cancel()
+		if err != nil {
+			t.Fatalf("Try() = %v", err)
+		}
+	}
+}
+
+// TestUpdateCapacityCapsExtendedResourceRevisions asserts that a revision
+// whose container requests an extended resource (e.g. nvidia.com/gpu) gets
+// capacity computed as if containerConcurrency were at most 1 per pod,
+// even when its declared containerConcurrency is higher: such resources
+// aren't safely shareable across concurrent requests the way CPU time-
+// slicing is, so admitting more than one in-flight request per pod would
+// oversubscribe the device.
+func TestUpdateCapacityCapsExtendedResourceRevisions(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		containerConcurrency  int
+		extendedResourceBound bool
+		numDests              int
+		numActivators         int
+		wantCapacity          int
+	}{{
+		name:                  "no extended resource, high concurrency divides normally",
+		containerConcurrency:  10,
+		extendedResourceBound: false,
+		numDests:              2,
+		numActivators:         1,
+		wantCapacity:          20,
+	}, {
+		name:                  "extended resource caps concurrency to 1 per pod",
+		containerConcurrency:  10,
+		extendedResourceBound: true,
+		numDests:              2,
+		numActivators:         1,
+		wantCapacity:          2,
+	}, {
+		name:                  "extended resource with containerConcurrency 1 is unaffected",
+		containerConcurrency:  1,
+		extendedResourceBound: true,
+		numDests:              3,
+		numActivators:         1,
+		wantCapacity:          3,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			rt := &revisionThrottler{
+				containerConcurrency:  tc.containerConcurrency,
+				extendedResourceBound: tc.extendedResourceBound,
+				breaker: queue.NewBreaker(queue.BreakerParams{
+					QueueDepth:      1,
+					MaxConcurrency:  defaultMaxConcurrency,
+					InitialCapacity: 0,
+				}),
+			}
+			rt.updateCapacity(tc.numDests, tc.numActivators)
+			if got := rt.breaker.Capacity(); got != tc.wantCapacity {
+				t.Errorf("Capacity() = %d, want %d", got, tc.wantCapacity)
+			}
+		})
+	}
+}
+
+// TestExtendedResourceBound exercises the helper getOrCreateRevisionThrottler
+// uses to populate revisionThrottler.extendedResourceBound from a
+// Revision's container spec.
+func TestExtendedResourceBound(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		container *corev1.Container
+		want      bool
+	}{{
+		name:      "nil container",
+		container: nil,
+		want:      false,
+	}, {
+		name:      "no resources",
+		container: &corev1.Container{},
+		want:      false,
+	}, {
+		name: "cpu/memory/ephemeral-storage only",
+		container: &corev1.Container{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:              resource.MustParse("1"),
+					corev1.ResourceMemory:           resource.MustParse("1Gi"),
+					corev1.ResourceEphemeralStorage: resource.MustParse("1Gi"),
+				},
+			},
+		},
+		want: false,
+	}, {
+		name: "gpu request",
+		container: &corev1.Container{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:                    resource.MustParse("1"),
+					corev1.ResourceName("nvidia.com/gpu"): resource.MustParse("1"),
+				},
+			},
+		},
+		want: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := extendedResourceBound(tc.container); got != tc.want {
+				t.Errorf("extendedResourceBound() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -1,3 +1,4 @@
+//go:build e2e
 // +build e2e
 
 /*
@@ -25,6 +26,7 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	pkgTest "knative.dev/pkg/test"
 	"knative.dev/pkg/test/spoof"
 	"knative.dev/serving/test"
@@ -110,3 +112,224 @@ func TestCustomResourcesLimits(t *testing.T) {
 		t.Fatalf("We shouldn't have got a response from bloating cow with %d MBs of Memory: %v", 500, err)
 	}
 }
+
+// TestCustomCPULimits asserts that a Revision's CPU limits/requests reach
+// the user container's pod spec and don't prevent the revision from
+// serving. It deliberately doesn't try to drive CPU contention to prove
+// throttling: doing that honestly needs a test-image endpoint that
+// actually burns CPU for a caller-specified duration, which doesn't exist
+// in this series, so asserting on a query param against the stock
+// Autoscale image would just be asserting the image returns 200, with or
+// without the limit in effect.
+func TestCustomCPULimits(t *testing.T) {
+	t.Parallel()
+	clients := test.Setup(t)
+
+	t.Log("Creating a new Route and Configuration with a CPU limit")
+	withResources := rtesting.WithResourceRequirements(corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU: resource.MustParse("200m"),
+		},
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU: resource.MustParse("200m"),
+		},
+	})
+
+	names := test.ResourceNames{
+		Service: test.ObjectNameForTest(t),
+		Image:   test.Autoscale,
+	}
+
+	test.CleanupOnInterrupt(func() { test.TearDown(clients, names) })
+	defer test.TearDown(clients, names)
+
+	objects, err := v1test.CreateServiceReady(t, clients, &names, withResources)
+	if err != nil {
+		t.Fatalf("Failed to create initial Service %v: %v", names.Service, err)
+	}
+	domain := objects.Route.Status.URL.Host
+
+	_, err = pkgTest.WaitForEndpointState(
+		clients.KubeClient,
+		t.Logf,
+		domain,
+		v1test.RetryingRouteInconsistency(pkgTest.MatchesAllOf(pkgTest.IsStatusOK)),
+		"CPULimitTestServesText",
+		test.ServingFlags.ResolvableDomain)
+	if err != nil {
+		t.Fatalf("Error probing domain %s: %v", domain, err)
+	}
+
+	pods, err := revisionPods(clients, objects.Revision.Namespace, objects.Revision.Name)
+	if err != nil {
+		t.Fatalf("Failed to list pods for revision %s: %v", objects.Revision.Name, err)
+	}
+	if len(pods) == 0 {
+		t.Fatal("No pods found for the revision")
+	}
+
+	wantCPU := resource.MustParse("200m")
+	got := userContainer(pods[0]).Resources
+	if got.Limits.Cpu().Cmp(wantCPU) != 0 {
+		t.Errorf("user container cpu limit = %s, want %s", got.Limits.Cpu().String(), wantCPU.String())
+	}
+	if got.Requests.Cpu().Cmp(wantCPU) != 0 {
+		t.Errorf("user container cpu request = %s, want %s", got.Requests.Cpu().String(), wantCPU.String())
+	}
+}
+
+// TestEphemeralStorageLimits asserts that a Revision's ephemeral-storage
+// limits/requests reach the user container's pod spec, the same way
+// TestCustomCPULimits checks CPU: there's no test-image behavior that
+// would let us drive and observe ephemeral-storage pressure end-to-end,
+// so this checks the one thing we can actually verify -- that the value
+// is plumbed through to the running pod.
+func TestEphemeralStorageLimits(t *testing.T) {
+	t.Parallel()
+	clients := test.Setup(t)
+
+	t.Log("Creating a new Route and Configuration with an ephemeral-storage limit")
+	withResources := rtesting.WithResourceRequirements(corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{
+			corev1.ResourceEphemeralStorage: resource.MustParse("512Mi"),
+		},
+		Requests: corev1.ResourceList{
+			corev1.ResourceEphemeralStorage: resource.MustParse("512Mi"),
+		},
+	})
+
+	names := test.ResourceNames{
+		Service: test.ObjectNameForTest(t),
+		Image:   test.Autoscale,
+	}
+
+	test.CleanupOnInterrupt(func() { test.TearDown(clients, names) })
+	defer test.TearDown(clients, names)
+
+	objects, err := v1test.CreateServiceReady(t, clients, &names, withResources)
+	if err != nil {
+		t.Fatalf("Failed to create initial Service %v: %v", names.Service, err)
+	}
+	domain := objects.Route.Status.URL.Host
+
+	_, err = pkgTest.WaitForEndpointState(
+		clients.KubeClient,
+		t.Logf,
+		domain,
+		v1test.RetryingRouteInconsistency(pkgTest.MatchesAllOf(pkgTest.IsStatusOK)),
+		"EphemeralStorageLimitTestServesText",
+		test.ServingFlags.ResolvableDomain)
+	if err != nil {
+		t.Fatalf("Error probing domain %s: %v", domain, err)
+	}
+
+	pods, err := revisionPods(clients, objects.Revision.Namespace, objects.Revision.Name)
+	if err != nil {
+		t.Fatalf("Failed to list pods for revision %s: %v", objects.Revision.Name, err)
+	}
+	if len(pods) == 0 {
+		t.Fatal("No pods found for the revision")
+	}
+
+	wantStorage := resource.MustParse("512Mi")
+	got := userContainer(pods[0]).Resources
+	if got.Limits.StorageEphemeral().Cmp(wantStorage) != 0 {
+		t.Errorf("user container ephemeral-storage limit = %s, want %s", got.Limits.StorageEphemeral().String(), wantStorage.String())
+	}
+	if got.Requests.StorageEphemeral().Cmp(wantStorage) != 0 {
+		t.Errorf("user container ephemeral-storage request = %s, want %s", got.Requests.StorageEphemeral().String(), wantStorage.String())
+	}
+}
+
+// TestGPURequest asserts that a Revision requesting an nvidia.com/gpu
+// extended resource is admitted with the resource reflected on the user
+// container, on clusters that run the NVIDIA device plugin. It's skipped
+// on clusters without schedulable GPU capacity, since most CI pools don't
+// have GPU nodes.
+//
+// This requests a whole GPU, not a fraction of one: standard
+// nvidia.com/gpu resources are integer-quantity and can't express
+// fractional allocation. Fractional GPU scheduling needs a device plugin
+// that exposes a time-sliced or MPS-backed extended resource, which isn't
+// something this series adds; that's future work, not this test.
+func TestGPURequest(t *testing.T) {
+	t.Parallel()
+	clients := test.Setup(t)
+
+	if !clusterHasGPUCapacity(t, clients) {
+		t.Skip("No nvidia.com/gpu capacity in this cluster; skipping")
+	}
+
+	withResources := rtesting.WithResourceRequirements(corev1.ResourceRequirements{
+		Limits: corev1.ResourceList{
+			"nvidia.com/gpu": resource.MustParse("1"),
+		},
+		Requests: corev1.ResourceList{
+			"nvidia.com/gpu": resource.MustParse("1"),
+		},
+	})
+
+	names := test.ResourceNames{
+		Service: test.ObjectNameForTest(t),
+		Image:   test.Autoscale,
+	}
+
+	test.CleanupOnInterrupt(func() { test.TearDown(clients, names) })
+	defer test.TearDown(clients, names)
+
+	objects, err := v1test.CreateServiceReady(t, clients, &names, withResources)
+	if err != nil {
+		t.Fatalf("Failed to create initial Service %v: %v", names.Service, err)
+	}
+
+	pods, err := revisionPods(clients, objects.Revision.Namespace, objects.Revision.Name)
+	if err != nil {
+		t.Fatalf("Failed to list pods for revision %s: %v", objects.Revision.Name, err)
+	}
+	if len(pods) == 0 {
+		t.Fatal("No pods found for the revision")
+	}
+
+	gotLimit := userContainer(pods[0]).Resources.Limits["nvidia.com/gpu"]
+	wantLimit := resource.MustParse("1")
+	if gotLimit.Cmp(wantLimit) != 0 {
+		t.Errorf("user container nvidia.com/gpu limit = %s, want %s", gotLimit.String(), wantLimit.String())
+	}
+}
+
+// revisionPods lists the pods backing a revision.
+func revisionPods(clients *test.Clients, namespace, revisionName string) ([]corev1.Pod, error) {
+	pods, err := clients.KubeClient.Kube.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("serving.knative.dev/revision=%s", revisionName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pods.Items, nil
+}
+
+// clusterHasGPUCapacity reports whether any node advertises schedulable
+// nvidia.com/gpu capacity.
+func clusterHasGPUCapacity(t *testing.T, clients *test.Clients) bool {
+	nodes, err := clients.KubeClient.Kube.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list nodes: %v", err)
+	}
+	for _, node := range nodes.Items {
+		if qty, ok := node.Status.Capacity["nvidia.com/gpu"]; ok && !qty.IsZero() {
+			return true
+		}
+	}
+	return false
+}
+
+// userContainer returns the user container from a revision pod, i.e. the
+// one that isn't queue-proxy.
+func userContainer(pod corev1.Pod) *corev1.Container {
+	for i, c := range pod.Spec.Containers {
+		if c.Name != "queue-proxy" {
+			return &pod.Spec.Containers[i]
+		}
+	}
+	return nil
+}